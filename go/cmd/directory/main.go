@@ -28,9 +28,10 @@ import (
 )
 
 type record struct {
-	PeerID string    `json:"peer_id"`
-	Addrs  []string  `json:"addrs"`
-	Last   time.Time `json:"last"`
+	PeerID       string    `json:"peer_id"`
+	Addrs        []string  `json:"addrs"`
+	Reachability string    `json:"reachability"`
+	Last         time.Time `json:"last"`
 }
 
 type memStore struct {
@@ -54,16 +55,42 @@ func (s *memStore) get(username string) (record, bool) {
 	return rec, ok
 }
 
+// prekeyStore holds the latest X25519 prekey each user has published, used
+// by peers to run an X3DH handshake before they've ever exchanged a
+// message directly.
+type prekeyStore struct {
+	mu   sync.RWMutex
+	data map[string]string // username -> base64 X25519 public key
+}
+
+func (s *prekeyStore) set(username, prekey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		s.data = map[string]string{}
+	}
+	s.data[username] = prekey
+}
+
+func (s *prekeyStore) get(username string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pk, ok := s.data[username]
+	return pk, ok
+}
+
 func main() {
 	addr := getenv("ADDR", "127.0.0.1:8080")
 	r := gin.Default()
 	store := &memStore{}
+	prekeys := &prekeyStore{}
 
 	r.POST("/register", func(c *gin.Context) {
 		var body struct {
-			Username string   `json:"username"`
-			PeerID   string   `json:"peer_id"`
-			Addrs    []string `json:"addrs"`
+			Username     string   `json:"username"`
+			PeerID       string   `json:"peer_id"`
+			Addrs        []string `json:"addrs"`
+			Reachability string   `json:"reachability"`
 		}
 		if err := c.BindJSON(&body); err != nil {
 			c.String(400, err.Error())
@@ -73,7 +100,10 @@ func main() {
 			c.String(400, "missing fields")
 			return
 		}
-		store.set(body.Username, record{PeerID: body.PeerID, Addrs: body.Addrs, Last: time.Now()})
+		if body.Reachability == "" {
+			body.Reachability = "unknown"
+		}
+		store.set(body.Username, record{PeerID: body.PeerID, Addrs: body.Addrs, Reachability: body.Reachability, Last: time.Now()})
 		c.JSON(200, gin.H{"ok": true})
 	})
 
@@ -88,7 +118,38 @@ func main() {
 			c.String(404, "not found")
 			return
 		}
-		c.JSON(200, gin.H{"peer_id": rec.PeerID, "addrs": rec.Addrs})
+		c.JSON(200, gin.H{"peer_id": rec.PeerID, "addrs": rec.Addrs, "reachability": rec.Reachability})
+	})
+
+	r.POST("/prekeys", func(c *gin.Context) {
+		var body struct {
+			Username string `json:"username"`
+			Prekey   string `json:"prekey"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		if body.Username == "" || body.Prekey == "" {
+			c.String(400, "missing fields")
+			return
+		}
+		prekeys.set(body.Username, body.Prekey)
+		c.JSON(200, gin.H{"ok": true})
+	})
+
+	r.GET("/prekeys", func(c *gin.Context) {
+		u := c.Query("username")
+		if u == "" {
+			c.String(400, "username required")
+			return
+		}
+		pk, ok := prekeys.get(u)
+		if !ok {
+			c.String(404, "not found")
+			return
+		}
+		c.JSON(200, gin.H{"username": u, "prekey": pk})
 	})
 
 	log.Println("📒 Directory on", addr)
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"p2p-llm-chat/node/proto"
+	"p2p-llm-chat/node/ratchet"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const HandshakeProtocolID = protocol.ID("/handshake/1.0.0")
+
+type handshakeInit struct {
+	FromUsername string `json:"from_username"`
+	IdentityPub  []byte `json:"identity_pub"`
+	EphemeralPub []byte `json:"ephemeral_pub"`
+}
+
+// peerSession pairs a ratchet session with the lock that must be held for
+// its entire lifetime, not just while swapping the map entry: Encrypt and
+// Decrypt mutate the chain keys, counters, and skipped-key list in place,
+// and two stream handlers for the same peer run in their own goroutines.
+type peerSession struct {
+	mu    sync.Mutex
+	state *ratchet.State
+}
+
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*peerSession // peerID -> session
+	dir      string
+
+	identityPriv, identityPub []byte
+	prekeyPriv, prekeyPub     []byte
+
+	dirClient *DirectoryClient
+	username  string
+}
+
+func newSessionManager(sessionsDir, identityKeyFile, prekeyFile string, dirClient *DirectoryClient, username string) (*SessionManager, error) {
+	identityPriv, identityPub, err := loadOrCreateX25519(identityKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("identity key: %w", err)
+	}
+	prekeyPriv, prekeyPub, err := loadOrCreateX25519(prekeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("prekey: %w", err)
+	}
+	if err := os.MkdirAll(sessionsDir, 0o700); err != nil {
+		return nil, err
+	}
+	return &SessionManager{
+		sessions:     map[string]*peerSession{},
+		dir:          sessionsDir,
+		identityPriv: identityPriv,
+		identityPub:  identityPub,
+		prekeyPriv:   prekeyPriv,
+		prekeyPub:    prekeyPub,
+		dirClient:    dirClient,
+		username:     username,
+	}, nil
+}
+
+func (sm *SessionManager) publishPrekey() error {
+	return sm.dirClient.PublishPrekey(sm.username, base64.StdEncoding.EncodeToString(sm.prekeyPub))
+}
+
+func loadOrCreateX25519(path string) (priv, pub []byte, err error) {
+	if data, err := os.ReadFile(path); err == nil {
+		if len(data) != 32 {
+			return nil, nil, fmt.Errorf("%s: want 32 bytes, got %d", path, len(data))
+		}
+		pub, err := curve25519.X25519(data, curve25519.Basepoint)
+		return data, pub, err
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	priv, pub, err = ratchet.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(path, priv, 0o600); err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+func (sm *SessionManager) sessionPath(peerID string) string {
+	return filepath.Join(sm.dir, peerID+".json")
+}
+
+// peerSessionFor returns a stable *peerSession for peerID, creating one if
+// needed, so callers can lock it across a whole encrypt/decrypt without
+// racing the map itself.
+func (sm *SessionManager) peerSessionFor(peerID string) *peerSession {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	ps, ok := sm.sessions[peerID]
+	if !ok {
+		ps = &peerSession{}
+		sm.sessions[peerID] = ps
+	}
+	return ps
+}
+
+// persist writes s to disk; callers must hold the owning peerSession's lock.
+func (sm *SessionManager) persist(peerID string, s *ratchet.State) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sm.sessionPath(peerID), data, 0o600)
+}
+
+func (sm *SessionManager) peerIDs() []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	out := make([]string, 0, len(sm.sessions))
+	for id, ps := range sm.sessions {
+		ps.mu.Lock()
+		established := ps.state != nil
+		ps.mu.Unlock()
+		if established {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// x3dhRootKey derives the shared root key from a 2-DH X3DH exchange:
+// DH(priv1, pub1) between the initiator's long-term identity key and the
+// responder's prekey, and DH(priv2, pub2) between the initiator's
+// ephemeral key and that same prekey; the responder's own identity key
+// takes no part. Diffie-Hellman is commutative,
+// so whichever side holds which private half, both land on the same pair
+// of shared secrets and therefore the same root key.
+func x3dhRootKey(priv1, pub1, priv2, pub2 []byte) ([]byte, error) {
+	dh1, err := curve25519.X25519(priv1, pub1)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := curve25519.X25519(priv2, pub2)
+	if err != nil {
+		return nil, err
+	}
+	r := hkdf.New(sha256.New, append(dh1, dh2...), nil, []byte("p2p-llm-chat/x3dh/root"))
+	out := make([]byte, 32)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// initiateHandshake runs the Alice side of the X3DH handshake against
+// toPeer and returns the resulting session; the caller holds toPeer's
+// peerSession lock and is responsible for storing and persisting it.
+func (sm *SessionManager) initiateHandshake(ctx context.Context, h host.Host, toPeer peer.ID, theirPrekey []byte) (*ratchet.State, error) {
+	ephPriv, ephPub, err := ratchet.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	rootKey, err := x3dhRootKey(sm.identityPriv, theirPrekey, ephPriv, theirPrekey)
+	if err != nil {
+		return nil, err
+	}
+	session, err := ratchet.NewAlice(rootKey, theirPrekey)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := h.NewStream(ctx, toPeer, HandshakeProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("handshake stream: %w", err)
+	}
+	defer s.Close()
+	msg := handshakeInit{FromUsername: sm.username, IdentityPub: sm.identityPub, EphemeralPub: ephPub}
+	if err := json.NewEncoder(s).Encode(msg); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// handleHandshake is the Bob side of the X3DH handshake.
+func (sm *SessionManager) handleHandshake(s network.Stream) {
+	defer s.Close()
+	var msg handshakeInit
+	if err := json.NewDecoder(bufio.NewReader(s)).Decode(&msg); err != nil {
+		log.Println("handshake decode:", err)
+		return
+	}
+	rootKey, err := x3dhRootKey(sm.prekeyPriv, msg.IdentityPub, sm.prekeyPriv, msg.EphemeralPub)
+	if err != nil {
+		log.Println("handshake x3dh:", err)
+		return
+	}
+	peerID := s.Conn().RemotePeer().String()
+	ps := sm.peerSessionFor(peerID)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.state = ratchet.NewBob(rootKey, sm.prekeyPriv, sm.prekeyPub)
+	if err := sm.persist(peerID, ps.state); err != nil {
+		log.Println("handshake save session:", err)
+		return
+	}
+	log.Printf("🔒 E2EE session established with %s (%s)", msg.FromUsername, peerID)
+}
+
+// EncryptForPeer returns the header+ciphertext for content addressed to
+// toPeer, establishing a session first if one doesn't exist yet. The whole
+// operation runs under toPeer's peerSession lock.
+func (sm *SessionManager) EncryptForPeer(ctx context.Context, h host.Host, toPeer peer.ID, toUsername string, content []byte) (*proto.MessageHeader, []byte, error) {
+	ps := sm.peerSessionFor(toPeer.String())
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.state == nil {
+		prekeyB64, err := sm.dirClient.FetchPrekey(toUsername)
+		if err != nil {
+			return nil, nil, fmt.Errorf("no prekey for %s: %w", toUsername, err)
+		}
+		theirPrekey, err := base64.StdEncoding.DecodeString(prekeyB64)
+		if err != nil {
+			return nil, nil, err
+		}
+		session, err := sm.initiateHandshake(ctx, h, toPeer, theirPrekey)
+		if err != nil {
+			return nil, nil, err
+		}
+		ps.state = session
+	}
+
+	hdr, ct, err := ps.state.Encrypt(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := sm.persist(toPeer.String(), ps.state); err != nil {
+		return nil, nil, err
+	}
+	return &proto.MessageHeader{DH: hdr.DH, PN: hdr.PN, N: hdr.N}, ct, nil
+}
+
+// DecryptFromPeer reverses EncryptForPeer using the session already
+// established with fromPeer.
+func (sm *SessionManager) DecryptFromPeer(fromPeer peer.ID, hdr *proto.MessageHeader, ciphertext []byte) ([]byte, error) {
+	sm.mu.Lock()
+	ps, ok := sm.sessions[fromPeer.String()]
+	sm.mu.Unlock()
+	if !ok {
+		return nil, errors.New("no E2EE session with peer " + fromPeer.String())
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.state == nil {
+		return nil, errors.New("no E2EE session with peer " + fromPeer.String())
+	}
+	pt, err := ps.state.Decrypt(ratchet.Header{DH: hdr.DH, PN: hdr.PN, N: hdr.N}, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.persist(fromPeer.String(), ps.state); err != nil {
+		return nil, err
+	}
+	return pt, nil
+}
+
+func (dc *DirectoryClient) PublishPrekey(username, prekeyB64 string) error {
+	body := fmt.Sprintf(`{"username":"%s","prekey":"%s"}`, username, prekeyB64)
+	req, _ := http.NewRequest("POST", dc.BaseURL+"/prekeys", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := dc.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("publish prekey failed: %s", string(data))
+	}
+	return nil
+}
+
+func (dc *DirectoryClient) FetchPrekey(username string) (string, error) {
+	req, _ := http.NewRequest("GET", dc.BaseURL+"/prekeys?username="+username, nil)
+	resp, err := dc.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		data, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("fetch prekey failed: %s", string(data))
+	}
+	var out struct {
+		Prekey string `json:"prekey"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Prekey, nil
+}
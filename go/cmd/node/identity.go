@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// loadOrCreateKey persists the node's libp2p key so restarts keep the same
+// PeerID, rather than invalidating every cached rendezvous/DHT record.
+func loadOrCreateKey(path string, kind string) (crypto.PrivKey, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		return crypto.UnmarshalPrivateKey(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	priv, err := generateKey(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+func generateKey(kind string) (crypto.PrivKey, error) {
+	switch kind {
+	case "ed25519", "":
+		priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, -1, rand.Reader)
+		return priv, err
+	case "rsa":
+		priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+		return priv, err
+	case "secp256k1":
+		priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Secp256k1, -1, rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unknown KEY_TYPE %q", kind)
+	}
+}
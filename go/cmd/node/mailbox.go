@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"p2p-llm-chat/node/proto"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+const MailboxProtocolID = protocol.ID("/p2p-llm-chat-mailbox/1.0.0")
+
+// mailboxRendezvous is the DHT provider key mailbox operators advertise
+// themselves under.
+const mailboxRendezvous = "/p2p-llm-chat/mailbox/1.0.0"
+
+// mailboxDrainInterval is how often a node with configured mailboxes
+// re-polls them, so messages deposited while it was briefly unreachable
+// (not just while it was fully offline) still arrive without waiting for
+// a restart.
+const mailboxDrainInterval = 2 * time.Minute
+
+// maxMailboxBytesPerRecipient and mailboxTTL are the defaults for a
+// mailbox operator's per-recipient cap and retention; MAILBOX_MAX_BYTES
+// and MAILBOX_TTL in main.go override them.
+var (
+	maxMailboxBytesPerRecipient = 10 << 20 // 10 MB
+	mailboxTTL                  = 7 * 24 * time.Hour
+)
+
+// mailboxDeposit is an envelope stored for a recipient who wasn't reachable.
+// When the sender has an E2EE session, Msg carries only Header+Ciphertext,
+// so a mailbox operator never sees plaintext.
+type mailboxDeposit struct {
+	ID         string            `json:"id"`
+	ToPeerID   string            `json:"to_peer_id"`
+	FromPeerID string            `json:"from_peer_id"`
+	Msg        proto.ChatMessage `json:"msg"`
+	Expiry     time.Time         `json:"expiry"`
+	Deposited  time.Time         `json:"deposited"`
+}
+
+type mailboxRPC struct {
+	Op       string           `json:"op"` // deposit | fetch | ack
+	Deposit  *mailboxDeposit  `json:"deposit,omitempty"`
+	Since    string           `json:"since,omitempty"`
+	IDs      []string         `json:"ids,omitempty"`
+	OK       bool             `json:"ok,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Deposits []mailboxDeposit `json:"deposits,omitempty"`
+}
+
+func writeFramed(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readFramed(r io.Reader, v any) error {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// MailboxStore persists deposits in a bbolt file, one bucket per recipient
+// peer ID.
+type MailboxStore struct {
+	db *bolt.DB
+}
+
+func openMailboxStore(path string) (*MailboxStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &MailboxStore{db: db}, nil
+}
+
+func (ms *MailboxStore) deposit(d mailboxDeposit) error {
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(d.ToPeerID))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		pruneExpiredAndOversized(b, maxMailboxBytesPerRecipient-len(data))
+		return b.Put([]byte(d.ID), data)
+	})
+}
+
+// pruneExpiredAndOversized drops expired entries and, while the bucket
+// still holds more than capBytes, the oldest remaining ones. deposit passes
+// the per-recipient cap minus the new entry's size, making room for it.
+func pruneExpiredAndOversized(b *bolt.Bucket, capBytes int) {
+	type entry struct {
+		key       []byte
+		deposited time.Time
+		size      int
+	}
+	var entries []entry
+	total := 0
+	now := time.Now()
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var d mailboxDeposit
+		if json.Unmarshal(v, &d) != nil || now.After(d.Expiry) {
+			b.Delete(k)
+			continue
+		}
+		entries = append(entries, entry{key: append([]byte{}, k...), deposited: d.Deposited, size: len(v)})
+		total += len(v)
+	}
+	for total > capBytes && len(entries) > 0 {
+		oldest := 0
+		for i, e := range entries {
+			if e.deposited.Before(entries[oldest].deposited) {
+				oldest = i
+			}
+		}
+		b.Delete(entries[oldest].key)
+		total -= entries[oldest].size
+		entries = append(entries[:oldest], entries[oldest+1:]...)
+	}
+}
+
+// fetch returns every deposit still held for peerID. Delivered messages
+// are expected to be removed with ack, so "since the last fetch" is
+// naturally just "everything that hasn't been acked yet" — the since
+// parameter exists for protocol symmetry with Inbox.Drain's own
+// after-style cursor, but an un-acked mailbox has nothing to skip past.
+func (ms *MailboxStore) fetch(peerID string) ([]mailboxDeposit, error) {
+	var out []mailboxDeposit
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(peerID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var d mailboxDeposit
+			if err := json.Unmarshal(v, &d); err != nil {
+				return nil
+			}
+			out = append(out, d)
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (ms *MailboxStore) ack(peerID string, ids []string) error {
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(peerID))
+		if b == nil {
+			return nil
+		}
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func serveMailbox(store *MailboxStore) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		r := bufio.NewReader(s)
+		var req mailboxRPC
+		if err := readFramed(r, &req); err != nil {
+			log.Println("mailbox read:", err)
+			return
+		}
+		var resp mailboxRPC
+		switch req.Op {
+		case "deposit":
+			if req.Deposit == nil {
+				resp = mailboxRPC{Error: "missing deposit"}
+				break
+			}
+			if err := store.deposit(*req.Deposit); err != nil {
+				resp = mailboxRPC{Error: err.Error()}
+				break
+			}
+			resp = mailboxRPC{OK: true}
+		case "fetch":
+			deposits, err := store.fetch(s.Conn().RemotePeer().String())
+			if err != nil {
+				resp = mailboxRPC{Error: err.Error()}
+				break
+			}
+			resp = mailboxRPC{OK: true, Deposits: deposits}
+		case "ack":
+			if err := store.ack(s.Conn().RemotePeer().String(), req.IDs); err != nil {
+				resp = mailboxRPC{Error: err.Error()}
+				break
+			}
+			resp = mailboxRPC{OK: true}
+		default:
+			resp = mailboxRPC{Error: "unknown op " + req.Op}
+		}
+		if err := writeFramed(s, resp); err != nil {
+			log.Println("mailbox write:", err)
+		}
+	}
+}
+
+func advertiseMailbox(ctx context.Context, disc discovery.Discovery) {
+	if disc == nil {
+		return
+	}
+	dutil.Advertise(ctx, disc, mailboxRendezvous, discovery.TTL(rendezvousTTL))
+}
+
+func findMailboxes(ctx context.Context, disc discovery.Discovery, max int) []peer.AddrInfo {
+	if disc == nil {
+		return nil
+	}
+	findCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	peerChan, err := disc.FindPeers(findCtx, mailboxRendezvous)
+	if err != nil {
+		return nil
+	}
+	var out []peer.AddrInfo
+	for info := range peerChan {
+		if info.ID == "" {
+			continue
+		}
+		out = append(out, info)
+		if len(out) >= max {
+			break
+		}
+	}
+	return out
+}
+
+// depositAtMailboxes stores msg at 1-3 mailbox operators discovered via
+// the DHT, for toPeer to pick up later.
+func depositAtMailboxes(ctx context.Context, h host.Host, disc discovery.Discovery, toPeer peer.ID, msg proto.ChatMessage) error {
+	mailboxes := findMailboxes(ctx, disc, 3)
+	if len(mailboxes) == 0 {
+		return fmt.Errorf("no mailbox operators found for offline delivery")
+	}
+	d := mailboxDeposit{
+		ID:         msg.ID,
+		ToPeerID:   toPeer.String(),
+		FromPeerID: h.ID().String(),
+		Msg:        msg,
+		Expiry:     time.Now().Add(mailboxTTL),
+		Deposited:  time.Now(),
+	}
+	var lastErr error
+	delivered := 0
+	for _, mb := range mailboxes {
+		if err := func() error {
+			depositCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			_ = h.Connect(depositCtx, mb)
+			s, err := h.NewStream(depositCtx, mb.ID, MailboxProtocolID)
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			if err := writeFramed(s, mailboxRPC{Op: "deposit", Deposit: &d}); err != nil {
+				return err
+			}
+			var resp mailboxRPC
+			if err := readFramed(bufio.NewReader(s), &resp); err != nil {
+				return err
+			}
+			if !resp.OK {
+				return fmt.Errorf("mailbox %s: %s", mb.ID, resp.Error)
+			}
+			return nil
+		}(); err != nil {
+			lastErr = err
+			continue
+		}
+		delivered++
+	}
+	if delivered == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// drainMailboxes fetches and acks any messages waiting at configured
+// mailbox operators, decrypting each before pushing it into inbox.
+func drainMailboxes(ctx context.Context, h host.Host, mailboxAddrs []peer.AddrInfo, sessions *SessionManager, inbox *Inbox) {
+	for _, mb := range mailboxAddrs {
+		func() {
+			connCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			if err := h.Connect(connCtx, mb); err != nil {
+				log.Println("mailbox connect:", mb.ID, err)
+				return
+			}
+			s, err := h.NewStream(connCtx, mb.ID, MailboxProtocolID)
+			if err != nil {
+				log.Println("mailbox stream:", mb.ID, err)
+				return
+			}
+			defer s.Close()
+
+			if err := writeFramed(s, mailboxRPC{Op: "fetch"}); err != nil {
+				log.Println("mailbox fetch write:", err)
+				return
+			}
+			var resp mailboxRPC
+			if err := readFramed(bufio.NewReader(s), &resp); err != nil {
+				log.Println("mailbox fetch read:", err)
+				return
+			}
+			if !resp.OK || len(resp.Deposits) == 0 {
+				return
+			}
+
+			var ids []string
+			for _, d := range resp.Deposits {
+				msg := d.Msg
+				if msg.Header != nil {
+					fromPeer, err := peer.Decode(d.FromPeerID)
+					if err != nil {
+						log.Println("mailbox from_peer_id:", err)
+						continue
+					}
+					pt, err := sessions.DecryptFromPeer(fromPeer, msg.Header, msg.Ciphertext)
+					if err != nil {
+						log.Println("mailbox decrypt:", err)
+						continue
+					}
+					msg.Content = string(pt)
+					msg.Header, msg.Ciphertext = nil, nil
+				}
+				inbox.Push(msg)
+				ids = append(ids, d.ID)
+			}
+			if len(ids) == 0 {
+				return
+			}
+			ackStream, err := h.NewStream(connCtx, mb.ID, MailboxProtocolID)
+			if err != nil {
+				log.Println("mailbox ack stream:", err)
+				return
+			}
+			defer ackStream.Close()
+			_ = writeFramed(ackStream, mailboxRPC{Op: "ack", IDs: ids})
+		}()
+	}
+}
@@ -21,7 +21,7 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -29,31 +29,87 @@ import (
 	"net/http"
 	"os"
 	"p2p-llm-chat/node/proto"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
 
 	libp2p "github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
-	"github.com/libp2p/go-libp2p/core/crypto"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
 	"github.com/multiformats/go-multiaddr"
 )
 
 const ChatProtocolID = protocol.ID("/p2p-llm-chat/1.0.0")
 
+// rendezvousTTL controls how often a peer re-advertises its rendezvous
+// record in the DHT.
+const rendezvousTTL = 10 * time.Minute
+
+// defaultBootstrapAddrs are the public IPFS bootstrap nodes, used to seed
+// the DHT when no BOOTSTRAP_ADDRS are configured and discovery mode needs
+// the DHT to actually be reachable.
+var defaultBootstrapAddrs = []string{
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Gd",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+}
+
+// rendezvousCID derives a stable CID from a username, used both as the
+// advertisement key a peer publishes itself under and as the key callers
+// query to find it.
+func rendezvousCID(username string) cid.Cid {
+	sum := sha256.Sum256([]byte("p2p-llm-chat/username/" + username))
+	digest, err := mh.Encode(sum[:], mh.SHA2_256)
+	if err != nil {
+		log.Fatal("rendezvous multihash:", err)
+	}
+	return cid.NewCidV1(cid.Raw, digest)
+}
+
+// peerCache is a small local peerstore of AddrInfo discovered via the DHT,
+// keyed by username so /send can skip a repeat DHT lookup for a peer it
+// already resolved.
+type peerCache struct {
+	mu   sync.RWMutex
+	data map[string]peer.AddrInfo
+}
+
+func (c *peerCache) get(username string) (peer.AddrInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	info, ok := c.data[username]
+	return info, ok
+}
+
+func (c *peerCache) set(username string, info peer.AddrInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data == nil {
+		c.data = map[string]peer.AddrInfo{}
+	}
+	c.data[username] = info
+}
+
 type DirectoryClient struct {
 	BaseURL string
 	Client  *http.Client
 }
 
-func (dc *DirectoryClient) Register(username, peerID string, addrs []string) error {
-	body := fmt.Sprintf(`{"username":"%s","peer_id":"%s","addrs":%s}`, username, peerID, toJSON(addrs))
+func (dc *DirectoryClient) Register(username, peerID string, addrs []string, reachability string) error {
+	body := fmt.Sprintf(`{"username":"%s","peer_id":"%s","addrs":%s,"reachability":"%s"}`, username, peerID, toJSON(addrs), reachability)
 	req, _ := http.NewRequest("POST", dc.BaseURL+"/register", strings.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := dc.Client.Do(req)
@@ -97,11 +153,21 @@ func toJSON(v any) string {
 type Inbox struct {
 	mu    sync.Mutex
 	queue []proto.ChatMessage
+	seen  map[string]bool
 }
 
+// Push appends m, ignoring a message ID already seen — mailbox redelivery
+// after a dropped ack would otherwise duplicate it in the inbox.
 func (i *Inbox) Push(m proto.ChatMessage) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
+	if i.seen == nil {
+		i.seen = map[string]bool{}
+	}
+	if i.seen[m.ID] {
+		return
+	}
+	i.seen[m.ID] = true
 	i.queue = append(i.queue, m)
 }
 
@@ -132,29 +198,127 @@ func main() {
 	listenHTTP := envOr("HTTP_ADDR", "127.0.0.1:8081")
 	dirURL := envOr("DIRECTORY_URL", "http://127.0.0.1:8080")
 	bootstrap := envOr("BOOTSTRAP_ADDRS", "")
+	// DHT-based rendezvous is the default peer discovery path now; the
+	// central HTTP directory is an opt-in fallback for networks where the
+	// DHT hasn't converged (set DISCOVERY_MODE=directory or hybrid).
+	discoveryMode := envOr("DISCOVERY_MODE", "dht") // dht | directory | hybrid
+	keyFile := envOr("KEY_FILE", "./node.key")
+	keyType := envOr("KEY_TYPE", "ed25519") // ed25519 | rsa | secp256k1
+	relayAddrs := parseRelayAddrs(envOr("RELAY_ADDRS", ""))
+	relayService := envOr("RELAY_SERVICE", "") == "1"
+
+	priv, err := loadOrCreateKey(keyFile, keyType)
+	if err != nil {
+		log.Fatal("load identity key:", err)
+	}
 
 	ctx := context.Background()
-	h, err := libp2p.New(
+	opts := []libp2p.Option{
 		libp2p.ListenAddrStrings(
 			"/ip4/0.0.0.0/tcp/0",
 			"/ip4/0.0.0.0/udp/0/quic-v1",
 		),
-		libp2p.Identity(generateKey()),
+		libp2p.Identity(priv),
 		libp2p.NATPortMap(),
-	)
+		libp2p.EnableRelay(),
+		libp2p.EnableHolePunching(),
+	}
+	if len(relayAddrs) > 0 {
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(relayAddrs))
+	}
+	if relayService {
+		opts = append(opts, libp2p.EnableRelayService())
+	}
+	h, err := libp2p.New(opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer h.Close()
 
-	// DHT
-	_, err = dht.New(ctx, h, dht.Mode(dht.ModeAuto))
+	reachability := &reachabilityTracker{hasRelay: len(relayAddrs) > 0}
+	watchReachability(h, reachability)
+
+	// DHT + rendezvous discovery
+	kad, err := dht.New(ctx, h, dht.Mode(dht.ModeAuto))
 	if err != nil {
 		log.Println("DHT init error:", err)
 	}
+	var disc discovery.Discovery
+	if kad != nil {
+		disc = drouting.NewRoutingDiscovery(kad)
+	}
+	peers := &peerCache{}
+
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		log.Fatal("gossipsub init:", err)
+	}
+	rooms := newRoomManager(ps, disc, h)
+
+	if discoveryMode != "directory" && bootstrap == "" {
+		bootstrap = strings.Join(defaultBootstrapAddrs, ",")
+	}
+
+	// Directory client + E2EE sessions
+	dir := &DirectoryClient{BaseURL: dirURL, Client: &http.Client{Timeout: 5 * time.Second}}
+	requireE2EE := envOr("REQUIRE_E2EE", "") == "1"
+	sessions, err := newSessionManager(
+		envOr("SESSIONS_DIR", "./sessions"),
+		envOr("IDENTITY_KEY_FILE", "./identity.x25519"),
+		envOr("PREKEY_FILE", "./node.prekey"),
+		dir, username,
+	)
+	if err != nil {
+		log.Fatal("E2EE session manager:", err)
+	}
+	h.SetStreamHandler(HandshakeProtocolID, sessions.handleHandshake)
+
+	// Store-and-forward mailbox
+	if v := envOr("MAILBOX_MAX_BYTES", ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			maxMailboxBytesPerRecipient = n
+		} else {
+			log.Println("bad MAILBOX_MAX_BYTES:", err)
+		}
+	}
+	if v := envOr("MAILBOX_TTL", ""); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			mailboxTTL = d
+		} else {
+			log.Println("bad MAILBOX_TTL:", err)
+		}
+	}
+	if envOr("MAILBOX_SERVICE", "") == "1" {
+		mailboxStore, err := openMailboxStore(envOr("MAILBOX_DB", "./mailbox.db"))
+		if err != nil {
+			log.Fatal("mailbox store:", err)
+		}
+		defer mailboxStore.db.Close()
+		h.SetStreamHandler(MailboxProtocolID, serveMailbox(mailboxStore))
+		advertiseMailbox(ctx, disc)
+		go func() {
+			ticker := time.NewTicker(rendezvousTTL)
+			defer ticker.Stop()
+			for range ticker.C {
+				advertiseMailbox(ctx, disc)
+			}
+		}()
+		log.Println("📮 mailbox service enabled")
+	}
+	configuredMailboxes := parseRelayAddrs(envOr("MAILBOXES", ""))
 
 	// Stream handler
 	inbox := &Inbox{}
+	if len(configuredMailboxes) > 0 {
+		drainMailboxes(ctx, h, configuredMailboxes, sessions, inbox)
+		go func() {
+			ticker := time.NewTicker(mailboxDrainInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				drainMailboxes(ctx, h, configuredMailboxes, sessions, inbox)
+			}
+		}()
+	}
 	h.SetStreamHandler(ChatProtocolID, func(s network.Stream) {
 		defer s.Close()
 		data, err := io.ReadAll(bufio.NewReader(s))
@@ -167,12 +331,23 @@ func main() {
 			log.Println("unmarshal:", err)
 			return
 		}
+		if msg.Header != nil {
+			pt, err := sessions.DecryptFromPeer(s.Conn().RemotePeer(), msg.Header, msg.Ciphertext)
+			if err != nil {
+				log.Println("E2EE decrypt:", err)
+				return
+			}
+			msg.Content = string(pt)
+			msg.Header = nil
+			msg.Ciphertext = nil
+		} else if requireE2EE {
+			log.Println("rejecting plaintext message from", msg.FromUser, "(REQUIRE_E2EE=1)")
+			return
+		}
 		inbox.Push(msg)
 		log.Printf("📩 Received from %s: %s\n", msg.FromUser, msg.Content)
 	})
 
-	// Register in directory
-	dir := &DirectoryClient{BaseURL: dirURL, Client: &http.Client{Timeout: 5 * time.Second}}
 	addrs := []string{}
 	peerIDStr := h.ID().String()
 	for _, a := range h.Addrs() {
@@ -180,11 +355,34 @@ func main() {
 		addrs = append(addrs, ma.String())
 	}
 
-	if err := dir.Register(username, peerIDStr, addrs); err != nil {
-		log.Fatal("directory register failed:", err)
+	// Directory registration is only needed when the directory is in play
+	// as a peer-discovery fallback; under the default dht mode, peers are
+	// found via rendezvous below instead. Prekey publication is a
+	// separate concern from peer discovery — the directory is still the
+	// only place peers look up each other's X3DH prekeys, so it happens
+	// regardless of discoveryMode.
+	if discoveryMode != "dht" {
+		if err := dir.Register(username, peerIDStr, addrs, reachability.get()); err != nil {
+			log.Fatal("directory register failed:", err)
+		}
+	}
+	if err := sessions.publishPrekey(); err != nil {
+		log.Println("publish prekey failed:", err)
 	}
 	log.Printf("👤 %s PeerID=%s", username, peerIDStr)
 
+	rendezvousKey := rendezvousCID(username).String()
+	if disc != nil && discoveryMode != "directory" {
+		dutil.Advertise(ctx, disc, rendezvousKey, discovery.TTL(rendezvousTTL))
+		go func() {
+			ticker := time.NewTicker(rendezvousTTL)
+			defer ticker.Stop()
+			for range ticker.C {
+				dutil.Advertise(ctx, disc, rendezvousKey, discovery.TTL(rendezvousTTL))
+			}
+		}()
+	}
+
 	// Bootstrap peers
 	if bootstrap != "" {
 		for _, addr := range strings.Split(bootstrap, ",") {
@@ -222,41 +420,44 @@ func main() {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		peerIDStr, addrs, err := dir.Lookup(body.ToUsername)
+		info, err := resolvePeer(ctx, discoveryMode, body.ToUsername, disc, peers, dir)
 		if err != nil {
 			c.JSON(404, gin.H{"error": "user not found"})
 			return
 		}
-		pi, err := peer.Decode(peerIDStr)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "bad peer id"})
-			return
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		sendCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		info := peer.AddrInfo{ID: pi}
-		for _, a := range addrs {
-			if ma, err := multiaddr.NewMultiaddr(a); err == nil {
-				info.Addrs = append(info.Addrs, ma)
-			}
-		}
-		_ = h.Connect(ctx, info)
-
-		s, err := h.NewStream(ctx, pi, ChatProtocolID)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "open stream failed: " + err.Error()})
-			return
-		}
-		defer s.Close()
 
 		msg := proto.ChatMessage{
 			ID:        uuid.NewString(),
 			FromUser:  username,
 			ToUser:    body.ToUsername,
-			Content:   body.Content,
 			Timestamp: time.Now(),
 		}
+		hdr, ct, err := sessions.EncryptForPeer(sendCtx, h, info.ID, body.ToUsername, []byte(body.Content))
+		if err != nil {
+			if requireE2EE {
+				c.JSON(500, gin.H{"error": "E2EE required but handshake failed: " + err.Error()})
+				return
+			}
+			msg.Content = body.Content
+		} else {
+			msg.Header, msg.Ciphertext = hdr, ct
+		}
 		b, _ := json.Marshal(msg)
+
+		_ = h.Connect(sendCtx, info)
+		s, err := h.NewStream(sendCtx, info.ID, ChatProtocolID)
+		if err != nil {
+			if depositErr := depositAtMailboxes(sendCtx, h, disc, info.ID, msg); depositErr != nil {
+				c.JSON(500, gin.H{"error": "open stream failed and no mailbox available: " + depositErr.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"status": "deposited", "id": msg.ID})
+			return
+		}
+		defer s.Close()
+
 		if _, err := s.Write(b); err != nil {
 			c.JSON(500, gin.H{"error": "write failed: " + err.Error()})
 			return
@@ -269,31 +470,73 @@ func main() {
 		c.JSON(200, inbox.Drain(after))
 	})
 
+	registerRoomRoutes(r, rooms, username)
+
 	r.GET("/me", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"username": username,
-			"peer_id":  string(h.ID()),
+			"peer_id":  h.ID().String(),
 			"addrs":    addrs,
 		})
 	})
 
+	r.GET("/sessions", func(c *gin.Context) {
+		c.JSON(200, gin.H{"peers": sessions.peerIDs()})
+	})
+
 	log.Println("📡 HTTP listening on", listenHTTP)
 	if err := r.Run(listenHTTP); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// resolvePeer finds an AddrInfo for toUsername according to discoveryMode:
+// it prefers a cached or freshly-discovered DHT rendezvous record and
+// falls back to the HTTP directory, unless the mode forbids one side.
+func resolvePeer(ctx context.Context, discoveryMode, toUsername string, disc discovery.Discovery, peers *peerCache, dir *DirectoryClient) (peer.AddrInfo, error) {
+	if discoveryMode != "directory" {
+		if info, ok := peers.get(toUsername); ok {
+			return info, nil
+		}
+		if disc != nil {
+			findCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			peerChan, err := disc.FindPeers(findCtx, rendezvousCID(toUsername).String())
+			if err == nil {
+				for info := range peerChan {
+					if info.ID == "" {
+						continue
+					}
+					peers.set(toUsername, info)
+					return info, nil
+				}
+			}
+		}
+		if discoveryMode == "dht" {
+			return peer.AddrInfo{}, fmt.Errorf("no DHT record for %s", toUsername)
+		}
+	}
+
+	peerIDStr, addrs, err := dir.Lookup(toUsername)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	pi, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	info := peer.AddrInfo{ID: pi}
+	for _, a := range addrs {
+		if ma, err := multiaddr.NewMultiaddr(a); err == nil {
+			info.Addrs = append(info.Addrs, ma)
+		}
+	}
+	return info, nil
+}
+
 func envOr(k, def string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
 	}
 	return def
 }
-
-func generateKey() crypto.PrivKey {
-	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return priv
-}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func parseRelayAddrs(csv string) []peer.AddrInfo {
+	var out []peer.AddrInfo
+	for _, addr := range strings.Split(csv, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			log.Println("bad relay addr:", addr, err)
+			continue
+		}
+		info, err := peer.AddrInfoFromP2pAddr(ma)
+		if err != nil {
+			log.Println("relay addrinfo:", addr, err)
+			continue
+		}
+		out = append(out, *info)
+	}
+	return out
+}
+
+// reachabilityTracker reports "relayed" rather than "private" once a relay
+// is configured, since that's the address type the directory should hand
+// out for this node.
+type reachabilityTracker struct {
+	mu       sync.RWMutex
+	value    string
+	hasRelay bool
+}
+
+func (t *reachabilityTracker) get() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.value == "" {
+		return "unknown"
+	}
+	return t.value
+}
+
+func (t *reachabilityTracker) set(r network.Reachability) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch r {
+	case network.ReachabilityPublic:
+		t.value = "public"
+	case network.ReachabilityPrivate:
+		if t.hasRelay {
+			t.value = "relayed"
+		} else {
+			t.value = "private"
+		}
+	default:
+		t.value = "unknown"
+	}
+}
+
+func watchReachability(h host.Host, t *reachabilityTracker) {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		log.Println("reachability subscribe:", err)
+		return
+	}
+	go func() {
+		defer sub.Close()
+		for ev := range sub.Out() {
+			e := ev.(event.EvtLocalReachabilityChanged)
+			t.set(e.Reachability)
+		}
+	}()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"p2p-llm-chat/node/proto"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+)
+
+func roomTopic(room string) string {
+	return fmt.Sprintf("/p2p-llm-chat/room/%s/1.0.0", room)
+}
+
+type Room struct {
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
+	inbox  *Inbox
+	cancel context.CancelFunc
+}
+
+type RoomManager struct {
+	mu    sync.Mutex
+	ps    *pubsub.PubSub
+	disc  discovery.Discovery
+	host  peerConnector
+	rooms map[string]*Room
+}
+
+// peerConnector is the subset of host.Host RoomManager needs, kept narrow
+// so it's easy to fake in tests.
+type peerConnector interface {
+	Connect(ctx context.Context, pi peer.AddrInfo) error
+}
+
+func newRoomManager(ps *pubsub.PubSub, disc discovery.Discovery, h peerConnector) *RoomManager {
+	return &RoomManager{ps: ps, disc: disc, host: h, rooms: map[string]*Room{}}
+}
+
+func (rm *RoomManager) Join(ctx context.Context, room string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if _, ok := rm.rooms[room]; ok {
+		return nil
+	}
+
+	topic, err := rm.ps.Join(roomTopic(room))
+	if err != nil {
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return err
+	}
+
+	roomCtx, cancel := context.WithCancel(ctx)
+	r := &Room{topic: topic, sub: sub, inbox: &Inbox{}, cancel: cancel}
+	rm.rooms[room] = r
+
+	go r.readLoop(roomCtx, room)
+
+	if rm.disc != nil {
+		dutil.Advertise(roomCtx, rm.disc, roomTopic(room), discovery.TTL(rendezvousTTL))
+		go rm.discoverRoomPeers(roomCtx, room)
+	}
+	return nil
+}
+
+func (rm *RoomManager) Leave(room string) {
+	rm.mu.Lock()
+	r, ok := rm.rooms[room]
+	if ok {
+		delete(rm.rooms, room)
+	}
+	rm.mu.Unlock()
+	if !ok {
+		return
+	}
+	r.cancel()
+	r.sub.Cancel()
+	r.topic.Close()
+}
+
+// Send requires the caller to have Join'ed room first.
+func (rm *RoomManager) Send(ctx context.Context, msg proto.ChatMessage) error {
+	rm.mu.Lock()
+	r, ok := rm.rooms[msg.RoomID]
+	rm.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not joined to room %s", msg.RoomID)
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return r.topic.Publish(ctx, b)
+}
+
+// Inbox returns the room's message buffer, or nil if not joined.
+func (rm *RoomManager) Inbox(room string) *Inbox {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	r, ok := rm.rooms[room]
+	if !ok {
+		return nil
+	}
+	return r.inbox
+}
+
+func (r *Room) readLoop(ctx context.Context, room string) {
+	for {
+		m, err := r.sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		var msg proto.ChatMessage
+		if err := json.Unmarshal(m.Data, &msg); err != nil {
+			log.Println("room unmarshal:", room, err)
+			continue
+		}
+		r.inbox.Push(msg)
+	}
+}
+
+// discoverRoomPeers connects to DHT-discovered room peers so gossipsub can
+// mesh even without a common bootstrap node.
+func (rm *RoomManager) discoverRoomPeers(ctx context.Context, room string) {
+	ticker := time.NewTicker(rendezvousTTL)
+	defer ticker.Stop()
+	lookup := func() {
+		findCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		peerChan, err := rm.disc.FindPeers(findCtx, roomTopic(room))
+		if err != nil {
+			return
+		}
+		for info := range peerChan {
+			if info.ID == "" {
+				continue
+			}
+			_ = rm.host.Connect(ctx, info)
+		}
+	}
+	lookup()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lookup()
+		}
+	}
+}
+
+func registerRoomRoutes(r *gin.Engine, rm *RoomManager, username string) {
+	r.POST("/rooms/join", func(c *gin.Context) {
+		var body struct {
+			Room string `json:"room"`
+		}
+		if err := c.BindJSON(&body); err != nil || body.Room == "" {
+			c.JSON(400, gin.H{"error": "room required"})
+			return
+		}
+		if err := rm.Join(context.Background(), body.Room); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"status": "joined", "room": body.Room})
+	})
+
+	r.POST("/rooms/leave", func(c *gin.Context) {
+		var body struct {
+			Room string `json:"room"`
+		}
+		if err := c.BindJSON(&body); err != nil || body.Room == "" {
+			c.JSON(400, gin.H{"error": "room required"})
+			return
+		}
+		rm.Leave(body.Room)
+		c.JSON(200, gin.H{"status": "left", "room": body.Room})
+	})
+
+	r.POST("/rooms/send", func(c *gin.Context) {
+		var body struct {
+			Room    string `json:"room"`
+			Content string `json:"content"`
+		}
+		if err := c.BindJSON(&body); err != nil || body.Room == "" {
+			c.JSON(400, gin.H{"error": "room required"})
+			return
+		}
+		msg := proto.ChatMessage{
+			ID:        uuid.NewString(),
+			FromUser:  username,
+			RoomID:    body.Room,
+			Content:   body.Content,
+			Timestamp: time.Now(),
+		}
+		if err := rm.Send(context.Background(), msg); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"status": "sent", "id": msg.ID})
+	})
+
+	r.GET("/rooms/:room/inbox", func(c *gin.Context) {
+		room := c.Param("room")
+		inbox := rm.Inbox(room)
+		if inbox == nil {
+			c.JSON(404, gin.H{"error": "not joined"})
+			return
+		}
+		c.JSON(200, inbox.Drain(c.Query("after")))
+	})
+}
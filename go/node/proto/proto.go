@@ -0,0 +1,32 @@
+// Package proto defines the wire messages exchanged between nodes over
+// ChatProtocolID and its sub-protocols.
+package proto
+
+import "time"
+
+// ChatMessage is the JSON payload written to a chat stream or published to
+// a room topic. A point-to-point message sets ToUser and leaves RoomID
+// empty; a room broadcast sets RoomID and leaves ToUser empty.
+//
+// A 1:1 message that has gone through the Double Ratchet sets Header and
+// Ciphertext and leaves Content empty; Content carries plaintext for
+// messages sent without an established E2EE session.
+type ChatMessage struct {
+	ID         string         `json:"id"`
+	FromUser   string         `json:"from_user"`
+	ToUser     string         `json:"to_user"`
+	RoomID     string         `json:"room_id,omitempty"`
+	Content    string         `json:"content"`
+	Header     *MessageHeader `json:"header,omitempty"`
+	Ciphertext []byte         `json:"ciphertext,omitempty"`
+	Timestamp  time.Time      `json:"timestamp"`
+}
+
+// MessageHeader is the Double Ratchet header carried alongside ciphertext:
+// the sender's current ratchet public key, the length of its previous
+// sending chain, and the message's position in its current one.
+type MessageHeader struct {
+	DH []byte `json:"dh"`
+	PN uint32 `json:"pn"`
+	N  uint32 `json:"n"`
+}
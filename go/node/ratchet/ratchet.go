@@ -0,0 +1,296 @@
+// Package ratchet implements a Double Ratchet session, the same
+// construction Signal uses to keep 1:1 messages forward-secret and able to
+// recover from lost or reordered deliveries.
+package ratchet
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxSkippedKeys bounds how many out-of-order message keys a session will
+// hold onto, so a peer can't force unbounded memory growth by advertising
+// a huge message number and never sending the messages in between.
+const maxSkippedKeys = 1000
+
+// Header travels alongside each ciphertext so the receiver knows which
+// ratchet step and chain position it belongs to.
+type Header struct {
+	DH []byte `json:"dh"` // sender's current ratchet public key
+	PN uint32 `json:"pn"` // length of the sender's previous sending chain
+	N  uint32 `json:"n"`  // message number within the current sending chain
+}
+
+type skippedEntry struct {
+	DH  []byte `json:"dh"`
+	N   uint32 `json:"n"`
+	Key []byte `json:"key"`
+}
+
+// State is the persisted ratchet session for one peer.
+type State struct {
+	DHSelfPriv  []byte         `json:"dh_self_priv"`
+	DHSelfPub   []byte         `json:"dh_self_pub"`
+	DHRemotePub []byte         `json:"dh_remote_pub,omitempty"`
+	RootKey     []byte         `json:"root_key"`
+	SendChain   []byte         `json:"send_chain,omitempty"`
+	RecvChain   []byte         `json:"recv_chain,omitempty"`
+	SendN       uint32         `json:"send_n"`
+	RecvN       uint32         `json:"recv_n"`
+	PN          uint32         `json:"pn"`
+	Skipped     []skippedEntry `json:"skipped,omitempty"`
+}
+
+func GenerateKeyPair() (priv, pub []byte, err error) {
+	priv = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// NewAlice starts a session for the party that initiated the X3DH
+// handshake: it knows the peer's prekey up front, so it can derive a
+// sending chain immediately with a single KDF_RK step, the same step Bob
+// will later perform on his side of that exact DH output. It must not
+// route through ratchetStep, which performs a full two-phase step (a
+// receiving-chain derivation followed by a second, fresh-keypair
+// sending-chain derivation) meant for reacting to an already-established
+// peer ratchet key, not for bootstrapping the first sending chain.
+func NewAlice(rootKey, remotePub []byte) (*State, error) {
+	selfPriv, selfPub, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	out, err := dh(selfPriv, remotePub)
+	if err != nil {
+		return nil, err
+	}
+	root, chain, err := kdfRootKey(rootKey, out)
+	if err != nil {
+		return nil, err
+	}
+	return &State{
+		DHSelfPriv:  selfPriv,
+		DHSelfPub:   selfPub,
+		DHRemotePub: remotePub,
+		RootKey:     root,
+		SendChain:   chain,
+	}, nil
+}
+
+// NewBob starts a session for the responder: it keeps its X3DH prekey
+// pair as its initial ratchet keypair and waits for Alice's first message
+// header to learn her ratchet public key.
+func NewBob(rootKey, selfPriv, selfPub []byte) *State {
+	return &State{RootKey: rootKey, DHSelfPriv: selfPriv, DHSelfPub: selfPub}
+}
+
+func dh(priv, pub []byte) ([]byte, error) {
+	return curve25519.X25519(priv, pub)
+}
+
+func hkdfSHA256(secret, info []byte, n int) ([]byte, error) {
+	r := hkdf.New(sha256.New, secret, nil, info)
+	out := make([]byte, n)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// kdfRootKey advances the root chain on a DH ratchet step, returning the
+// next root key and the chain key for the new sending/receiving chain.
+func kdfRootKey(rootKey, dhOut []byte) (newRoot, chainKey []byte, err error) {
+	out, err := hkdfSHA256(append(append([]byte{}, rootKey...), dhOut...), []byte("p2p-llm-chat/ratchet/root"), 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+// kdfChainKey advances a sending/receiving chain by one message, deriving
+// the next chain key and this message's key.
+func kdfChainKey(chainKey []byte) (nextChainKey, messageKey []byte, err error) {
+	out, err := hkdfSHA256(chainKey, []byte("msg"), 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+func nonceForCounter(n uint32) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint32(nonce[chacha20poly1305.NonceSize-4:], n)
+	return nonce
+}
+
+func seal(key, plaintext []byte, n uint32) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonceForCounter(n), plaintext, nil), nil
+}
+
+func open(key, ciphertext []byte, n uint32) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonceForCounter(n), ciphertext, nil)
+}
+
+// ratchetStep performs a DH ratchet against a new remote public key: it
+// resets the chain counters, derives the new receiving chain from our
+// current ratchet keypair (when we have one) and remotePub, then always
+// generates a fresh ratchet keypair and derives the new sending chain
+// from it.
+func (s *State) ratchetStep(remotePub []byte) error {
+	s.PN = s.SendN
+	s.SendN = 0
+	s.RecvN = 0
+	s.DHRemotePub = remotePub
+
+	if s.DHSelfPriv != nil {
+		out, err := dh(s.DHSelfPriv, remotePub)
+		if err != nil {
+			return err
+		}
+		root, chain, err := kdfRootKey(s.RootKey, out)
+		if err != nil {
+			return err
+		}
+		s.RootKey, s.RecvChain = root, chain
+	}
+
+	selfPriv, selfPub, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	s.DHSelfPriv, s.DHSelfPub = selfPriv, selfPub
+
+	out, err := dh(s.DHSelfPriv, remotePub)
+	if err != nil {
+		return err
+	}
+	root, chain, err := kdfRootKey(s.RootKey, out)
+	if err != nil {
+		return err
+	}
+	s.RootKey, s.SendChain = root, chain
+	return nil
+}
+
+// Encrypt advances the sending chain by one step and seals plaintext under
+// the resulting message key.
+func (s *State) Encrypt(plaintext []byte) (Header, []byte, error) {
+	if s.SendChain == nil {
+		return Header{}, nil, errors.New("ratchet: no sending chain established")
+	}
+	nextChain, msgKey, err := kdfChainKey(s.SendChain)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	h := Header{DH: s.DHSelfPub, PN: s.PN, N: s.SendN}
+	ct, err := seal(msgKey, plaintext, s.SendN)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	s.SendChain = nextChain
+	s.SendN++
+	return h, ct, nil
+}
+
+// Decrypt accepts a header+ciphertext pair, performing a DH ratchet step
+// if the sender has rotated its ratchet key, and handles out-of-order
+// delivery via the bounded skipped-key cache.
+func (s *State) Decrypt(h Header, ciphertext []byte) ([]byte, error) {
+	if pt, ok, err := s.trySkipped(h, ciphertext); ok || err != nil {
+		return pt, err
+	}
+
+	if s.DHRemotePub == nil || !bytesEqual(h.DH, s.DHRemotePub) {
+		if err := s.skipMessageKeys(s.RecvChain, s.RecvN, h.PN); err != nil {
+			return nil, err
+		}
+		if err := s.ratchetStep(h.DH); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.skipMessageKeys(s.RecvChain, s.RecvN, h.N); err != nil {
+		return nil, err
+	}
+
+	nextChain, msgKey, err := kdfChainKey(s.RecvChain)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := open(msgKey, ciphertext, h.N)
+	if err != nil {
+		return nil, err
+	}
+	s.RecvChain = nextChain
+	s.RecvN = h.N + 1
+	return pt, nil
+}
+
+// skipMessageKeys derives and stashes message keys for chain positions
+// [from, until), so a later out-of-order message can still be decrypted.
+func (s *State) skipMessageKeys(chain []byte, from, until uint32) error {
+	if chain == nil || until <= from {
+		return nil
+	}
+	if len(s.Skipped)+int(until-from) > maxSkippedKeys {
+		return errors.New("ratchet: too many skipped messages")
+	}
+	for n := from; n < until; n++ {
+		nextChain, msgKey, err := kdfChainKey(chain)
+		if err != nil {
+			return err
+		}
+		s.Skipped = append(s.Skipped, skippedEntry{DH: s.DHRemotePub, N: n, Key: msgKey})
+		chain = nextChain
+	}
+	s.RecvChain = chain
+	s.RecvN = until
+	return nil
+}
+
+func (s *State) trySkipped(h Header, ciphertext []byte) ([]byte, bool, error) {
+	for i, e := range s.Skipped {
+		if e.N == h.N && bytesEqual(e.DH, h.DH) {
+			pt, err := open(e.Key, ciphertext, h.N)
+			if err != nil {
+				return nil, true, err
+			}
+			s.Skipped = append(s.Skipped[:i], s.Skipped[i+1:]...)
+			return pt, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package ratchet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newTestSession sets up an Alice/Bob pair the way e2ee.go's handshake
+// does: Bob's ratchet keypair is his X3DH prekey, known to Alice up
+// front, and both sides start from the same (stand-in) X3DH root key.
+func newTestSession(t *testing.T) (*State, *State) {
+	t.Helper()
+	bobPriv, bobPub, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	rootKey := bytes.Repeat([]byte{0x42}, 32)
+
+	alice, err := NewAlice(rootKey, bobPub)
+	if err != nil {
+		t.Fatalf("NewAlice: %v", err)
+	}
+	bob := NewBob(rootKey, bobPriv, bobPub)
+	return alice, bob
+}
+
+func TestAliceBobRoundTrip(t *testing.T) {
+	alice, bob := newTestSession(t)
+
+	h, ct, err := alice.Encrypt([]byte("hello bob"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	pt, err := bob.Decrypt(h, ct)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if string(pt) != "hello bob" {
+		t.Fatalf("got %q, want %q", pt, "hello bob")
+	}
+
+	// And a reply in the other direction, which forces Bob's DH ratchet
+	// key (generated inside his first ratchetStep) back to Alice.
+	h2, ct2, err := bob.Encrypt([]byte("hi alice"))
+	if err != nil {
+		t.Fatalf("bob Encrypt: %v", err)
+	}
+	pt2, err := alice.Decrypt(h2, ct2)
+	if err != nil {
+		t.Fatalf("alice Decrypt: %v", err)
+	}
+	if string(pt2) != "hi alice" {
+		t.Fatalf("got %q, want %q", pt2, "hi alice")
+	}
+}
+
+func TestOutOfOrderDelivery(t *testing.T) {
+	alice, bob := newTestSession(t)
+
+	var headers []Header
+	var ciphertexts [][]byte
+	for _, msg := range []string{"one", "two", "three"} {
+		h, ct, err := alice.Encrypt([]byte(msg))
+		if err != nil {
+			t.Fatalf("Encrypt(%q): %v", msg, err)
+		}
+		headers = append(headers, h)
+		ciphertexts = append(ciphertexts, ct)
+	}
+
+	// Deliver message 2, then 0, then 1: message 2 forces two skipped
+	// keys to be stashed, which the later-arriving messages must then
+	// find and consume out of the skipped cache.
+	order := []int{2, 0, 1}
+	want := []string{"three", "one", "two"}
+	for i, idx := range order {
+		pt, err := bob.Decrypt(headers[idx], ciphertexts[idx])
+		if err != nil {
+			t.Fatalf("Decrypt message %d: %v", idx, err)
+		}
+		if string(pt) != want[i] {
+			t.Fatalf("message %d: got %q, want %q", idx, pt, want[i])
+		}
+	}
+}
+
+func TestSkippedKeysBound(t *testing.T) {
+	alice, bob := newTestSession(t)
+
+	// Run the sending chain past maxSkippedKeys without ever decrypting,
+	// then try to decrypt the last message: Bob must refuse rather than
+	// stash an unbounded number of skipped message keys.
+	var last Header
+	var lastCT []byte
+	for i := 0; i < maxSkippedKeys+2; i++ {
+		h, ct, err := alice.Encrypt([]byte("msg"))
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		last, lastCT = h, ct
+	}
+
+	if _, err := bob.Decrypt(last, lastCT); err == nil {
+		t.Fatal("expected error decrypting after exceeding maxSkippedKeys, got nil")
+	}
+}